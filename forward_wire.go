@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// forwardMagicByte is written as the very first byte of every forwarding connection speaking the
+// framed protocol below. It lets the receiving end reject a mis-pointed statsd client cleanly,
+// rather than handing its bytes to a decoder that would otherwise block forever waiting for
+// something that looks like a valid frame.
+const forwardMagicByte byte = 0xE7
+
+// forwardProtocolVersion is the version advertised in the handshake. Bump it when the frame format
+// changes in a way older peers can't decode.
+const forwardProtocolVersion = 1
+
+// forwardMaxFrameSize bounds a single forwarded snapshot frame, guarding against a corrupt or
+// malicious length prefix asking us to allocate something absurd.
+const forwardMaxFrameSize = 64 << 20 // 64MB
+
+// forwardFeatures lists the stat kinds the framed protocol's snapshot encoding carries, and is
+// advertised in the handshake. The receiving end decodes and merges all four. The sending end only
+// aggregates counters for forwarding (handleMessage rejects forwarded stats of any other type), so
+// the snapshots it sends hold counters only, as the legacy gob path below did.
+var forwardFeatures = []string{"counters", "timers", "sets", "gauges"}
+
+// forwardHandshakeTimeout bounds how long we wait for the magic byte before assuming the peer is an
+// older gost that will never send one. It's tied to the flush interval because that's how long an
+// old peer can legitimately go without writing anything.
+func forwardHandshakeTimeout() time.Duration {
+	return time.Duration(conf.FlushIntervalMS) * time.Millisecond
+}
+
+// forwardHandshake is exchanged once, right after the magic byte, similar to how DERP-style servers
+// negotiate capabilities on connect.
+type forwardHandshake struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+// writeForwardPreamble writes the magic byte and this gost's handshake to conn. Callers should do
+// this once, immediately after dialing.
+func writeForwardPreamble(conn net.Conn) error {
+	if _, err := conn.Write([]byte{forwardMagicByte}); err != nil {
+		return err
+	}
+	hs, err := json.Marshal(forwardHandshake{Version: forwardProtocolVersion, Features: forwardFeatures})
+	if err != nil {
+		return err
+	}
+	return writeForwardFrame(conn, hs)
+}
+
+// writeForwardSnapshot frames and writes a BufferedStats snapshot, encoded by encodeForwardSnapshot
+// rather than gob so that, unlike the legacy format, a non-Go peer could in principle decode it too.
+// Snapshots are sent every flush interval for potentially thousands of names, so unlike the one-shot
+// handshake above, the wire format here is a compact length-prefixed binary encoding rather than
+// JSON.
+func writeForwardSnapshot(conn net.Conn, snap *BufferedStats) error {
+	return writeForwardFrame(conn, encodeForwardSnapshot(snap))
+}
+
+// encodeForwardSnapshot serializes a BufferedStats snapshot into a compact binary layout, all
+// integers big-endian:
+//
+//	uint32 counterCount, then per counter: uint16 nameLen, name bytes, float64 value
+//	uint32 gaugeCount,   then per gauge:   uint16 nameLen, name bytes, float64 value
+//	uint32 timerCount,   then per timer:   uint16 nameLen, name bytes, uint32 valueCount, float64 values...
+//	uint32 setCount,     then per set:     uint16 nameLen, name bytes, uint32 itemCount, float64 items...
+func encodeForwardSnapshot(snap *BufferedStats) []byte {
+	var buf bytes.Buffer
+	writeForwardFloatMap(&buf, snap.Counts)
+	writeForwardFloatMap(&buf, snap.Gauges)
+	writeForwardTimers(&buf, snap.Timers)
+	writeForwardSets(&buf, snap.Sets)
+	return buf.Bytes()
+}
+
+// decodeForwardSnapshot parses the format written by encodeForwardSnapshot.
+func decodeForwardSnapshot(payload []byte) (*BufferedStats, error) {
+	r := bytes.NewReader(payload)
+	counts, err := readForwardFloatMap(r)
+	if err != nil {
+		return nil, fmt.Errorf("counters: %w", err)
+	}
+	gauges, err := readForwardFloatMap(r)
+	if err != nil {
+		return nil, fmt.Errorf("gauges: %w", err)
+	}
+	timers, err := readForwardTimers(r)
+	if err != nil {
+		return nil, fmt.Errorf("timers: %w", err)
+	}
+	sets, err := readForwardSets(r)
+	if err != nil {
+		return nil, fmt.Errorf("sets: %w", err)
+	}
+	return &BufferedStats{Counts: counts, Gauges: gauges, Timers: timers, Sets: sets}, nil
+}
+
+func writeForwardFloatMap(buf *bytes.Buffer, m map[string]float64) {
+	writeForwardUint32(buf, uint32(len(m)))
+	for name, v := range m {
+		writeForwardString(buf, name)
+		writeForwardFloat64(buf, v)
+	}
+}
+
+func readForwardFloatMap(r *bytes.Reader) (map[string]float64, error) {
+	n, err := readForwardUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]float64, n)
+	for i := uint32(0); i < n; i++ {
+		name, err := readForwardString(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readForwardFloat64(r)
+		if err != nil {
+			return nil, err
+		}
+		m[name] = v
+	}
+	return m, nil
+}
+
+func writeForwardTimers(buf *bytes.Buffer, timers map[string][]float64) {
+	writeForwardUint32(buf, uint32(len(timers)))
+	for name, values := range timers {
+		writeForwardString(buf, name)
+		writeForwardUint32(buf, uint32(len(values)))
+		for _, v := range values {
+			writeForwardFloat64(buf, v)
+		}
+	}
+}
+
+func readForwardTimers(r *bytes.Reader) (map[string][]float64, error) {
+	n, err := readForwardUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	timers := make(map[string][]float64, n)
+	for i := uint32(0); i < n; i++ {
+		name, err := readForwardString(r)
+		if err != nil {
+			return nil, err
+		}
+		count, err := readForwardUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]float64, count)
+		for j := range values {
+			v, err := readForwardFloat64(r)
+			if err != nil {
+				return nil, err
+			}
+			values[j] = v
+		}
+		timers[name] = values
+	}
+	return timers, nil
+}
+
+func writeForwardSets(buf *bytes.Buffer, sets map[string]map[float64]struct{}) {
+	writeForwardUint32(buf, uint32(len(sets)))
+	for name, items := range sets {
+		writeForwardString(buf, name)
+		writeForwardUint32(buf, uint32(len(items)))
+		for v := range items {
+			writeForwardFloat64(buf, v)
+		}
+	}
+}
+
+func readForwardSets(r *bytes.Reader) (map[string]map[float64]struct{}, error) {
+	n, err := readForwardUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	sets := make(map[string]map[float64]struct{}, n)
+	for i := uint32(0); i < n; i++ {
+		name, err := readForwardString(r)
+		if err != nil {
+			return nil, err
+		}
+		count, err := readForwardUint32(r)
+		if err != nil {
+			return nil, err
+		}
+		items := make(map[float64]struct{}, count)
+		for j := uint32(0); j < count; j++ {
+			v, err := readForwardFloat64(r)
+			if err != nil {
+				return nil, err
+			}
+			items[v] = struct{}{}
+		}
+		sets[name] = items
+	}
+	return sets, nil
+}
+
+func writeForwardString(buf *bytes.Buffer, s string) {
+	var lenBuf [2]byte
+	binary.BigEndian.PutUint16(lenBuf[:], uint16(len(s)))
+	buf.Write(lenBuf[:])
+	buf.WriteString(s)
+}
+
+func readForwardString(r *bytes.Reader) (string, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func writeForwardUint32(buf *bytes.Buffer, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
+
+func readForwardUint32(r *bytes.Reader) (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+func writeForwardFloat64(buf *bytes.Buffer, v float64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(v))
+	buf.Write(b[:])
+}
+
+func readForwardFloat64(r *bytes.Reader) (float64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b[:])), nil
+}
+
+// writeForwardFrame writes a single 4-byte-big-endian-length-prefixed frame.
+func writeForwardFrame(conn net.Conn, payload []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(payload)))
+	if _, err := conn.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := conn.Write(payload)
+	return err
+}
+
+// readForwardFrame reads a single 4-byte-big-endian-length-prefixed frame from r.
+func readForwardFrame(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n > forwardMaxFrameSize {
+		return nil, fmt.Errorf("forwarded frame of %d bytes exceeds max of %d", n, forwardMaxFrameSize)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// handleForwardedConn speaks the framed, versioned forwarding protocol (or falls back to the legacy
+// gob format) on an accepted connection, pushing decoded snapshots into forwarderIncoming until the
+// connection closes.
+//
+// Detection works by peeking the first byte: if it's forwardMagicByte, the peer is speaking the
+// framed protocol and we consume the handshake and read framed snapshots. Otherwise -- including the
+// case where the peer hasn't sent anything yet, which we give up to one flush interval to happen --
+// we assume a peer that hasn't been upgraded and fall back to decoding the raw gob stream of
+// counters that older gost versions send, without losing whatever bytes we already buffered.
+func handleForwardedConn(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+
+	c.SetReadDeadline(time.Now().Add(forwardHandshakeTimeout()))
+	magic, err := br.Peek(1)
+	c.SetReadDeadline(time.Time{})
+
+	if err != nil || magic[0] != forwardMagicByte {
+		handleForwardedLegacy(br)
+		return
+	}
+	br.Discard(1)
+
+	hsFrame, err := readForwardFrame(br)
+	if err != nil {
+		Errorf(FacetForward, "forwarded_message_read", "Error reading forwarding handshake: %s", err)
+		return
+	}
+	var hs forwardHandshake
+	if err := json.Unmarshal(hsFrame, &hs); err != nil {
+		Errorf(FacetForward, "forwarded_message_read", "Error decoding forwarding handshake: %s", err)
+		return
+	}
+	Debugf(FacetForward, "Forwarding peer %s handshook at version %d with features %v", c.RemoteAddr(), hs.Version, hs.Features)
+
+	for {
+		frame, err := readForwardFrame(br)
+		if err != nil {
+			if err == io.EOF {
+				return
+			}
+			Errorf(FacetForward, "forwarded_message_read", "Error reading forwarded message: %s", err)
+			return
+		}
+		snap, err := decodeForwardSnapshot(frame)
+		if err != nil {
+			Errorf(FacetForward, "forwarded_message_read", "Error decoding forwarded message: %s", err)
+			continue
+		}
+		forwarderIncoming <- snap
+	}
+}
+
+// handleForwardedLegacy decodes the pre-protocol-versioning wire format: a bare, unframed stream of
+// gob-encoded counter maps, exactly as older gost instances still send. r must be positioned at the
+// start of the connection (or of whatever the caller already peeked without consuming).
+func handleForwardedLegacy(r io.Reader) {
+	decoder := gob.NewDecoder(r)
+	for {
+		var counts map[string]float64
+		if err := decoder.Decode(&counts); err != nil {
+			if err == io.EOF {
+				return
+			}
+			Errorf(FacetForward, "forwarded_message_read", "Error reading forwarded message (legacy gob): %s", err)
+			return
+		}
+		forwarderIncoming <- &BufferedStats{Counts: counts}
+	}
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/gob"
+	"context"
 	"flag"
 	"fmt"
-	"io"
-	"log"
 	"net"
 	"sync"
 	"time"
@@ -23,6 +22,11 @@ const (
 
 	// All TCP connections managed by gost have this keepalive duration applied
 	tcpKeepAlivePeriod = 30 * time.Second
+
+	// defaultMaxStatsdLineSize bounds a single newline-delimited statsd frame read over TCP or a Unix
+	// socket when conf.MaxStatsdLineSize is unset; a longer line ends that connection's reading.
+	// conf.MaxStatsdLineSize replaces this cap for clients that send larger batches.
+	defaultMaxStatsdLineSize = 64 * 1024
 )
 
 var (
@@ -31,16 +35,16 @@ var (
 
 	bufPool = make(chan []byte, nUDPBufs) // pool of buffers for incoming messagse
 
-	incoming = make(chan *Stat, incomingQueueSize) // incoming stats are passed to the aggregator
-	outgoing = make(chan []byte)                   // outgoing Graphite messages
+	shards []*aggregatorShard // aggregation shards; see shard.go
 
-	stats = NewBufferedStats()
+	sinks         []Sink // configured output sinks; see sink.go
+	forwardedSink Sink   // sink that forwardedStats is flushed to, when forwarderEnabled
 
-	forwardingEnabled  bool                 // Whether configured to forward to another gost
-	forwardingStats    = NewBufferedStats() // Counters to be forwarded
+	forwardingEnabled  bool                          // Whether configured to forward to another gost
+	forwardingStats    = NewBufferedStats()          // Counters to be forwarded
 	forwardKeyPrefix   = []byte("f|")
-	forwardingIncoming chan *Stat          // incoming messages to be forwarded
-	forwardingOutgoing = make(chan []byte) // outgoing forwarded messages
+	forwardingIncoming chan *Stat                    // incoming messages to be forwarded
+	forwardingOutgoing = make(chan *BufferedStats)   // outgoing forwarding snapshots, one per flush
 
 	// Whether configured to receive forwarded messages
 	forwarderEnabled  bool
@@ -61,6 +65,8 @@ func init() {
 	for i := 0; i < nUDPBufs; i++ {
 		bufPool <- make([]byte, udpBufSize)
 	}
+	// debugServer is a logWriter like any other; see logging.go.
+	registerLogWriter(debugServer)
 }
 
 type StatType int
@@ -112,107 +118,161 @@ func handleMessage(msg []byte) {
 	if len(msg) == 0 {
 		return
 	}
-	debugServer.Print("[in] ", msg)
+	Debugf(FacetNet, "in: %s", msg)
 	stat, ok := parseStatsdMessage(msg)
 	if !ok {
-		log.Println("bad message:", string(msg))
-		metaInc("errors.bad_message")
+		Errorf(FacetNet, "bad_message", "bad message: %s", msg)
 		return
 	}
 	if stat.Forward {
 		if stat.Type != StatCounter {
-			metaInc("errors.bad_metric_type_for_forwarding")
+			Errorf(FacetNet, "bad_metric_type_for_forwarding", "bad metric type for forwarding: %s", stat.Name)
 			return
 		}
 		forwardingIncoming <- stat
 	} else {
-		incoming <- stat
+		shardFor(stat.Name).incoming <- stat
 	}
 }
 
-func clientServer(c *net.UDPConn) error {
+func clientServer(ctx context.Context, c *net.UDPConn) error {
 	for {
 		buf := <-bufPool
 		n, _, err := c.ReadFromUDP(buf)
-		// TODO: Should we try to recover from such errors?
 		if err != nil {
+			// Closing c during shutdown unblocks ReadFromUDP with an error; that's expected, not a
+			// failure.
+			if ctx.Err() != nil {
+				return nil
+			}
+			// TODO: Should we try to recover from such errors?
 			return err
 		}
 		metaInc("packets_received")
 		if n >= udpBufSize {
-			metaInc("errors.udp_message_too_large")
+			Errorf(FacetNet, "udp_message_too_large", "udp message of %d bytes exceeds buffer size %v", n, udpBufSize)
 			continue
 		}
 		go handleMessages(buf[:n])
 	}
 }
 
-// aggregateForwarded merges forwarded gost messages.
-func aggregateForwarded() {
-	ticker := aggregateForwardedFlushTicker()
+// streamServer accepts connections from listener and hands each one to handleStatsdStream along with
+// metaKey (e.g. "packets_received.tcp"), which it bumps once per received line; the UDP listener
+// instead bumps packets_received once per datagram, which may hold several lines. It's shared by the
+// TCP and Unix-domain-socket statsd listeners,
+// which differ only in how the listener was constructed.
+func streamServer(ctx context.Context, listener net.Listener, metaKey string) error {
 	for {
-		select {
-		case count := <-forwarderIncoming:
-			forwardedStats.Merge(count)
-		case <-ticker:
-			n, msg := forwardedStats.CreateGraphiteMessage(conf.ForwardedNamespace,
-				"distinct_forwarded_metrics_flushed")
-			dbg.Printf("Sending %d forwarded stat(s) to graphite.", n)
-			outgoing <- msg
-			forwardedStats.Clear(!conf.ClearStatsBetweenFlushes)
+		c, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				delay := 10 * time.Millisecond
+				Warnf(FacetNet, "Accept error: %v; retrying in %v", e, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
 		}
+		go handleStatsdStream(c, metaKey)
 	}
 }
 
-func handleForwarded(c net.Conn) {
-	decoder := gob.NewDecoder(c)
+// handleStatsdStream reads newline-delimited statsd frames of arbitrary length from c until the
+// connection is closed or a line exceeds the configured maximum, bumping metaKey and handing each one
+// to handleMessage. This is the TCP/Unix-socket counterpart to the fixed-size UDP buffers in
+// clientServer: clients with large batches, or running somewhere UDP delivery isn't reliable, can
+// use it without risking errors.udp_message_too_large.
+func handleStatsdStream(c net.Conn, metaKey string) {
+	defer c.Close()
+	maxLineSize := conf.MaxStatsdLineSize
+	if maxLineSize <= 0 {
+		maxLineSize = defaultMaxStatsdLineSize
+	}
+	scanner := bufio.NewScanner(c)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxLineSize)
+	for scanner.Scan() {
+		metaInc(metaKey)
+		handleMessage(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil {
+		Errorf(FacetNet, "statsd_stream_read", "Error reading statsd stream: %s", err)
+	}
+}
+
+// tcpServer listens for statsd clients speaking newline-delimited statsd over TCP. listener is
+// expected to be wrapped in tcpKeepAliveListener so idle connections are kept alive.
+func tcpServer(ctx context.Context, listener net.Listener) error {
+	return streamServer(ctx, listener, "packets_received.tcp")
+}
+
+// unixServer listens for statsd clients speaking newline-delimited statsd over a Unix domain socket.
+func unixServer(ctx context.Context, listener net.Listener) error {
+	return streamServer(ctx, listener, "packets_received.unix")
+}
+
+// aggregateForwarded merges forwarded gost messages. Every flush interval it writes forwardedStats
+// to forwardedSink. main always passes a Graphite sink at conf.GraphiteAddr under
+// conf.ForwardedNamespace; conf.Sinks does not apply to forwarded stats.
+func aggregateForwarded(ctx context.Context, forwardedSink Sink) {
+	ticker := aggregateForwardedFlushTicker()
 	for {
-		var counts map[string]float64
-		if err := decoder.Decode(&counts); err != nil {
-			if err == io.EOF {
-				return
-			}
-			log.Println("Error reading forwarded message:", err)
-			metaInc("errors.forwarded_message_read")
+		select {
+		case <-ctx.Done():
 			return
+		case count := <-forwarderIncoming:
+			forwardedStats.Merge(count)
+		case <-ticker:
+			Debugf(FacetForward, "Flushing forwarded stats.")
+			if err := forwardedSink.Write(ctx, forwardedStats); err != nil {
+				Errorf(FacetSink, "sink."+forwardedSink.Name()+".write", "forwarded sink %s failed to write: %s", forwardedSink.Name(), err)
+			}
+			forwardedStats.Clear(!conf.ClearStatsBetweenFlushes)
 		}
-		forwarderIncoming <- &BufferedStats{Counts: counts}
 	}
 }
 
-func forwardServer(listener net.Listener) error {
+func forwardServer(ctx context.Context, listener net.Listener) error {
 	for {
 		c, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
 			if e, ok := err.(net.Error); ok && e.Temporary() {
 				delay := 10 * time.Millisecond
-				log.Printf("Accept error: %v; retrying in %v", e, delay)
+				Warnf(FacetForward, "Accept error: %v; retrying in %v", e, delay)
 				time.Sleep(delay)
 				continue
 			}
 			return err
 		}
-		go handleForwarded(c)
+		go handleForwardedConn(c)
 	}
 }
 
 // aggregateForwarding reads incoming forward messages and aggregates them. Every flush interval it forwards
 // the collected stats.
-func aggregateForwarding() {
+func aggregateForwarding(ctx context.Context) {
 	ticker := aggregateForwardingFlushTicker()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case stat := <-forwardingIncoming:
 			if stat.Type == StatCounter {
 				forwardingStats.AddCount(stat.Name, stat.Value/stat.SampleRate)
 			}
 		case <-ticker:
-			n, msg := forwardingStats.CreateForwardMessage()
+			n, snap := forwardingStats.CreateForwardSnapshot()
 			if n > 0 {
-				dbg.Printf("Forwarding %d stat(s).", n)
-				forwardingOutgoing <- msg
+				Debugf(FacetForward, "Forwarding %d stat(s).", n)
+				forwardingOutgoing <- snap
 			} else {
-				dbg.Println("No stats to forward.")
+				Debugf(FacetForward, "No stats to forward.")
 			}
 			// Always delete forwarded stats -- they are cleared/preserved between flushes at the receiving end.
 			forwardingStats.Clear(false)
@@ -220,54 +280,24 @@ func aggregateForwarding() {
 	}
 }
 
-// flushForwarding pushes forwarding messages to another gost instance.
-func flushForwarding() {
+// flushForwarding pushes forwarding snapshots to another gost instance over the framed protocol (see
+// forward_wire.go). It always speaks the framed protocol; the legacy gob fallback exists only on the
+// receiving end (handleForwardedConn), for senders that haven't been upgraded yet.
+func flushForwarding(ctx context.Context) {
 	conn := DialPConn(conf.ForwardingAddr)
 	defer conn.Close()
-	for msg := range forwardingOutgoing {
-		debugMsg := fmt.Sprintf("<binary forwarding message; len = %d bytes>", len(msg))
-		debugServer.Print("[forward]", []byte(debugMsg))
-		if _, err := conn.Write(msg); err != nil {
-			log.Printf("Warning: could not write forwarding message to %s: %s", conf.ForwardingAddr, err)
-		}
+	if err := writeForwardPreamble(conn); err != nil {
+		Warnf(FacetForward, "could not send forwarding handshake to %s: %s", conf.ForwardingAddr, err)
 	}
-}
-
-// aggregate reads the incoming messages and aggregates them. It sends them to be flushed every flush
-// interval.
-func aggregate() {
-	ticker := aggregateFlushTicker()
 	for {
 		select {
-		case stat := <-incoming:
-			key := stat.Name
-			switch stat.Type {
-			case StatCounter:
-				stats.AddCount(key, stat.Value/stat.SampleRate)
-			case StatSet:
-				stats.AddSetItem(key, stat.Value)
-			case StatGauge:
-				stats.SetGauge(key, stat.Value)
-			case StatTimer:
-				stats.RecordTimer(key, stat.Value)
+		case <-ctx.Done():
+			return
+		case snap := <-forwardingOutgoing:
+			Debugf(FacetForward, "forwarding snapshot sent")
+			if err := writeForwardSnapshot(conn, snap); err != nil {
+				Warnf(FacetForward, "could not write forwarding message to %s: %s", conf.ForwardingAddr, err)
 			}
-		case <-ticker:
-			n, msg := stats.CreateGraphiteMessage(conf.Namespace, "distinct_metrics_flushed")
-			dbg.Printf("Flushing %d stat(s).", n)
-			outgoing <- msg
-			stats.Clear(!conf.ClearStatsBetweenFlushes)
-		}
-	}
-}
-
-// flush pushes outgoing messages to graphite.
-func flush() {
-	conn := DialPConn(conf.GraphiteAddr)
-	defer conn.Close()
-	for msg := range outgoing {
-		debugServer.Print("[out] ", msg)
-		if _, err := conn.Write(msg); err != nil {
-			log.Printf("Warning: could not write message to Graphite at %s: %s", conf.GraphiteAddr, err)
 		}
 	}
 }
@@ -280,7 +310,7 @@ type dServer struct {
 
 func (s *dServer) Start(port int) error {
 	addr := fmt.Sprintf("127.0.0.1:%d", port)
-	log.Println("Listening for debug TCP clients on", addr)
+	Infof(FacetNet, "Listening for debug TCP clients on %s", addr)
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
@@ -293,50 +323,58 @@ func (s *dServer) Start(port int) error {
 			}
 			s.Lock()
 			s.Clients = append(s.Clients, c)
-			dbg.Printf("Debug client connected. Currently %d connected client(s).", len(s.Clients))
+			Debugf(FacetNet, "Debug client connected. Currently %d connected client(s).", len(s.Clients))
 			s.Unlock()
 		}
 	}()
 	return nil
 }
 
+// closeAll closes every currently connected debug client. It's called during shutdown so gost
+// doesn't leave debug sockets dangling after it stops serving stats.
+func (s *dServer) closeAll() {
+	s.Lock()
+	defer s.Unlock()
+	for _, c := range s.Clients {
+		c.Close()
+	}
+	s.Clients = nil
+}
+
 func (s *dServer) closeClient(client net.Conn) {
 	for i, c := range s.Clients {
 		if c == client {
 			s.Clients = append(s.Clients[:i], s.Clients[i+1:]...)
 			client.Close()
-			dbg.Printf("Debug client disconnected. Currently %d connected client(s).", len(s.Clients))
+			Debugf(FacetNet, "Debug client disconnected. Currently %d connected client(s).", len(s.Clients))
 			return
 		}
 	}
 }
 
-func (s *dServer) Print(tag string, msg []byte) {
+// WriteLog makes dServer a logWriter (see logging.go): every emitted record, regardless of level, is
+// formatted as "[facet] message" and fanned out to connected debug clients. dServer no longer needs
+// to be poked from individual log call sites -- it just receives whatever the rest of the process
+// logs, same as stderrLogWriter does.
+func (s *dServer) WriteLog(r Record) {
 	s.Lock()
 	defer s.Unlock()
 	if len(s.Clients) == 0 {
 		return
 	}
 
+	msg := []byte(fmt.Sprintf("[%s] %s\n", r.Facet, r.Message))
 	closed := []net.Conn{}
-	for _, line := range bytes.Split(msg, []byte{'\n'}) {
-		if len(line) == 0 {
-			continue
-		}
-		msg := append([]byte(tag), line...)
-		msg = append(msg, '\n')
-		for _, c := range s.Clients {
-			// Set an aggressive write timeout so a slow debug client can't impact performance.
-			c.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
-			if _, err := c.Write(msg); err != nil {
-				closed = append(closed, c)
-				continue
-			}
-		}
-		for _, c := range closed {
-			s.closeClient(c)
+	for _, c := range s.Clients {
+		// Set an aggressive write timeout so a slow debug client can't impact performance.
+		c.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err := c.Write(msg); err != nil {
+			closed = append(closed, c)
 		}
 	}
+	for _, c := range closed {
+		s.closeClient(c)
+	}
 }
 
 type tcpKeepAliveListener struct {
@@ -366,8 +404,22 @@ func main() {
 	aggregateForwardedFlushTicker = aggregateFlushTicker
 	aggregateForwardingFlushTicker = aggregateFlushTicker
 
-	go flush()
-	go aggregate()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sinkConfs := conf.Sinks
+	if len(sinkConfs) == 0 {
+		// Preserve gost's original behavior with zero sink config: a single Graphite sink at
+		// conf.GraphiteAddr.
+		sinkConfs = []SinkConf{{Name: "graphite", Type: "graphite", Addr: conf.GraphiteAddr}}
+	}
+	var err error
+	sinks, err = newSinks(sinkConfs)
+	if err != nil {
+		Fatalf(FacetSink, "%s", err)
+	}
+	go waitForShutdown(cancel)
+
+	startShards(ctx)
 	if conf.OSStats != nil {
 		go checkOSStats()
 	}
@@ -380,34 +432,84 @@ func main() {
 		// somehow messages are interpreted as forwarded messages even when forwarding is turned off (which should
 		// never happen). Otherwise the behavior would be to fill up the queue and then deadlock.
 		forwardingIncoming = make(chan *Stat, incomingQueueSize)
-		go flushForwarding()
-		go aggregateForwarding()
+		go flushForwarding(ctx)
+		go aggregateForwarding(ctx)
 	}
 
 	if forwarderEnabled {
-		log.Println("Listening for forwarded gost messages on", conf.ForwarderListenAddr)
+		Infof(FacetNet, "Listening for forwarded gost messages on %s", conf.ForwarderListenAddr)
 		l, err := net.Listen("tcp", conf.ForwarderListenAddr)
 		if err != nil {
-			log.Fatal(err)
+			Fatalf(FacetNet, "%s", err)
 		}
 		listener := tcpKeepAliveListener{l.(*net.TCPListener)}
-		go aggregateForwarded()
-		go func() { log.Fatal(forwardServer(listener)) }()
+		registerListener(listener)
+		forwardedSink, err = newGraphiteSink(SinkConf{
+			Name:        "forwarded_graphite",
+			Addr:        conf.GraphiteAddr,
+			Namespace:   conf.ForwardedNamespace,
+			MetaCounter: "distinct_forwarded_metrics_flushed",
+		})
+		if err != nil {
+			Fatalf(FacetSink, "%s", err)
+		}
+		go aggregateForwarded(ctx, forwardedSink)
+		go func() {
+			if err := forwardServer(ctx, listener); err != nil {
+				Fatalf(FacetForward, "%s", err)
+			}
+		}()
 	}
 
 	if err := debugServer.Start(conf.DebugPort); err != nil {
-		log.Fatal(err)
+		Fatalf(FacetNet, "%s", err)
+	}
+
+	if conf.TCPPort != 0 {
+		tcpAddr := fmt.Sprintf("localhost:%d", conf.TCPPort)
+		l, err := net.Listen("tcp", tcpAddr)
+		if err != nil {
+			Fatalf(FacetNet, "%s", err)
+		}
+		Infof(FacetNet, "Listening for TCP client requests on %s", tcpAddr)
+		listener := tcpKeepAliveListener{l.(*net.TCPListener)}
+		registerListener(listener)
+		go func() {
+			if err := tcpServer(ctx, listener); err != nil {
+				Fatalf(FacetNet, "%s", err)
+			}
+		}()
+	}
+
+	if conf.UnixSocketPath != "" {
+		l, err := net.Listen("unix", conf.UnixSocketPath)
+		if err != nil {
+			Fatalf(FacetNet, "%s", err)
+		}
+		Infof(FacetNet, "Listening for Unix socket client requests on %s", conf.UnixSocketPath)
+		registerListener(l)
+		go func() {
+			if err := unixServer(ctx, l); err != nil {
+				Fatalf(FacetNet, "%s", err)
+			}
+		}()
 	}
 
 	udpAddr := fmt.Sprintf("localhost:%d", conf.Port)
 	udp, err := net.ResolveUDPAddr("udp", udpAddr)
 	if err != nil {
-		log.Fatal(err)
+		Fatalf(FacetNet, "%s", err)
 	}
-	log.Println("Listening for UDP client requests on", udp)
+	Infof(FacetNet, "Listening for UDP client requests on %s", udp)
 	conn, err := net.ListenUDP("udp", udp)
 	if err != nil {
-		log.Fatal(err)
+		Fatalf(FacetNet, "%s", err)
+	}
+	registerListener(conn)
+	if err := clientServer(ctx, conn); err != nil {
+		Fatalf(FacetNet, "%s", err)
 	}
-	log.Fatal(clientServer(conn))
+	// clientServer only returns nil once shutdown has closed conn; block here so main doesn't return
+	// (and implicitly exit) before waitForShutdown finishes draining and flushing.
+	<-shutdownComplete
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log record, ordered from least to most severe.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	case LevelFatal:
+		return "FATAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Facet groups log records by the subsystem that emitted them, so GOST_TRACE can enable Debug output
+// selectively instead of all-or-nothing.
+type Facet string
+
+const (
+	FacetNet     Facet = "net"     // statsd ingestion: UDP/TCP/Unix listeners, parsing, debug clients
+	FacetAgg     Facet = "agg"     // shard aggregation
+	FacetForward Facet = "forward" // forwarding to/from other gost instances
+	FacetSink    Facet = "sink"    // output sinks
+)
+
+// Record is a single structured log event. Every logWriter sees every emitted record regardless of
+// level or facet; it decides for itself what, if anything, to do with it.
+type Record struct {
+	Time    time.Time
+	Level   Level
+	Facet   Facet
+	Message string
+}
+
+// logWriter receives every log record as it's emitted. stderrLogWriter and dServer (see gost.go) are
+// both logWriters -- dServer is just the writer that happens to forward records on to connected debug
+// clients instead of (or as well as) the process log.
+type logWriter interface {
+	WriteLog(Record)
+}
+
+var logWriters struct {
+	sync.Mutex
+	all []logWriter
+}
+
+// registerLogWriter adds w to the set of writers that receive every emitted log record.
+func registerLogWriter(w logWriter) {
+	logWriters.Lock()
+	defer logWriters.Unlock()
+	logWriters.all = append(logWriters.all, w)
+}
+
+// traceFacets and traceAll are parsed once from GOST_TRACE, e.g. "net,forward" or "all". They gate
+// which facets' Debug-level records are emitted at all -- Info and above always go out regardless.
+var traceFacets, traceAll = parseTrace(os.Getenv("GOST_TRACE"))
+
+func parseTrace(v string) (map[Facet]bool, bool) {
+	facets := make(map[Facet]bool)
+	for _, f := range strings.Split(v, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if f == "all" {
+			return facets, true
+		}
+		facets[Facet(f)] = true
+	}
+	return facets, false
+}
+
+func traced(facet Facet) bool {
+	return traceAll || traceFacets[facet]
+}
+
+// stderrLogWriter is the default logWriter, registered below: it formats records the way log.Println
+// already did and writes Warn and above to stderr. Debug and Info are left to other writers (dServer)
+// since they're too noisy for the process log.
+type stderrLogWriter struct{}
+
+func (stderrLogWriter) WriteLog(r Record) {
+	if r.Level < LevelWarn {
+		return
+	}
+	log.Printf("[%s] %s", r.Level, r.Message)
+}
+
+func init() {
+	registerLogWriter(stderrLogWriter{})
+}
+
+func emit(r Record) {
+	logWriters.Lock()
+	ws := append([]logWriter(nil), logWriters.all...)
+	logWriters.Unlock()
+	for _, w := range ws {
+		w.WriteLog(r)
+	}
+}
+
+// Debugf emits a Debug-level record for facet, gated by GOST_TRACE: if facet isn't being traced, the
+// message is never formatted or emitted.
+func Debugf(facet Facet, format string, args ...interface{}) {
+	if !traced(facet) {
+		return
+	}
+	emit(Record{Time: now(), Level: LevelDebug, Facet: facet, Message: fmt.Sprintf(format, args...)})
+}
+
+// Infof emits an Info-level record for facet.
+func Infof(facet Facet, format string, args ...interface{}) {
+	emit(Record{Time: now(), Level: LevelInfo, Facet: facet, Message: fmt.Sprintf(format, args...)})
+}
+
+// Warnf emits a Warn-level record for facet. Use this for conditions worth logging that don't map to
+// a meta counter; use Errorf when they do.
+func Warnf(facet Facet, format string, args ...interface{}) {
+	emit(Record{Time: now(), Level: LevelWarn, Facet: facet, Message: fmt.Sprintf(format, args...)})
+}
+
+// Errorf emits an Error-level record for facet and bumps metaInc("errors." + metaKey), so an error log
+// always increments its matching meta counter instead of relying on the call site to remember to do
+// both separately.
+func Errorf(facet Facet, metaKey string, format string, args ...interface{}) {
+	metaInc("errors." + metaKey)
+	emit(Record{Time: now(), Level: LevelError, Facet: facet, Message: fmt.Sprintf(format, args...)})
+}
+
+// Fatalf emits a Fatal-level record for facet and exits with status 1, like log.Fatal. main and the
+// goroutines it starts use it for every fatal startup or listener error.
+func Fatalf(facet Facet, format string, args ...interface{}) {
+	emit(Record{Time: now(), Level: LevelFatal, Facet: facet, Message: fmt.Sprintf(format, args...)})
+	os.Exit(1)
+}
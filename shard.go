@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"runtime"
+)
+
+// aggregatorShard owns a slice of the incoming stat stream and its own BufferedStats. Splitting
+// aggregation into shards removes the single-goroutine bottleneck of funneling every *Stat through
+// one channel and one BufferedStats: a stat's name always hashes to the same shard, so counters,
+// timers and sets stay correct, but unrelated names are free to aggregate on different cores.
+type aggregatorShard struct {
+	incoming chan *Stat
+	stats    *BufferedStats
+
+	// flush lets a foreign goroutine (shutdown's mergeAllShards) request an out-of-band snapshot of
+	// stats without touching it directly: it sends a response channel on flush and the owning
+	// aggregateShard goroutine writes the snapshot back, the same way results does for ticker-driven
+	// flushes. This keeps every read and write of stats on the one goroutine that owns it.
+	flush chan chan *BufferedStats
+}
+
+// numAggregationShards returns the configured number of aggregation shards, defaulting to
+// runtime.GOMAXPROCS(0) so gost scales with the host by default.
+func numAggregationShards() int {
+	if conf.AggregationShards > 0 {
+		return conf.AggregationShards
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// shardFor returns the shard responsible for name, computed as an fnv-1a hash of the name bytes
+// modulo the shard count.
+func shardFor(name string) *aggregatorShard {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return shards[h.Sum32()%uint32(len(shards))]
+}
+
+// startShards creates the aggregation shards and starts one aggregateShard goroutine per shard plus
+// the coordinator goroutine that stitches their flushes back together and fans them out to sinks.
+func startShards(ctx context.Context) {
+	n := numAggregationShards()
+	shards = make([]*aggregatorShard, n)
+	for i := range shards {
+		shards[i] = &aggregatorShard{
+			incoming: make(chan *Stat, incomingQueueSize),
+			stats:    NewBufferedStats(),
+			flush:    make(chan chan *BufferedStats),
+		}
+	}
+
+	results := make(chan *BufferedStats, n)
+	for _, s := range shards {
+		go aggregateShard(ctx, s, results)
+	}
+	go aggregateShardResults(ctx, n, results)
+}
+
+// aggregateShard reads a single shard's incoming stats and aggregates them into its own
+// BufferedStats. Every flush interval it clones its current stats (so the coordinator can merge and
+// fan them out without racing the shard's own next tick) and hands the clone to results.
+func aggregateShard(ctx context.Context, s *aggregatorShard, results chan<- *BufferedStats) {
+	ticker := aggregateFlushTicker()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case stat := <-s.incoming:
+			key := stat.Name
+			switch stat.Type {
+			case StatCounter:
+				s.stats.AddCount(key, stat.Value/stat.SampleRate)
+			case StatSet:
+				s.stats.AddSetItem(key, stat.Value)
+			case StatGauge:
+				s.stats.SetGauge(key, stat.Value)
+			case StatTimer:
+				s.stats.RecordTimer(key, stat.Value)
+			}
+		case <-ticker:
+			snap := NewBufferedStats()
+			snap.Merge(s.stats)
+			results <- snap
+			s.stats.Clear(!conf.ClearStatsBetweenFlushes)
+		case respCh := <-s.flush:
+			snap := NewBufferedStats()
+			snap.Merge(s.stats)
+			respCh <- snap
+		}
+	}
+}
+
+// aggregateShardResults is the flush coordinator: once per flush round it collects exactly one
+// snapshot from every shard (their tickers are all built with the same interval, so rounds stay
+// aligned), merges them into a single combined BufferedStats, and fans that out to every configured
+// sink concurrently.
+func aggregateShardResults(ctx context.Context, n int, results <-chan *BufferedStats) {
+	for {
+		combined := mergeShards(ctx, n, results)
+		if combined == nil {
+			return
+		}
+		Debugf(FacetAgg, "Flushing stats across %d shard(s) to %d sink(s).", n, len(sinks))
+		fanOutSinks(ctx, sinks, combined)
+	}
+}
+
+// mergeShards collects one snapshot from each of n shards and merges them into a single
+// BufferedStats, returning nil if ctx is done before a full round completes.
+func mergeShards(ctx context.Context, n int, results <-chan *BufferedStats) *BufferedStats {
+	combined := NewBufferedStats()
+	for i := 0; i < n; i++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case snap := <-results:
+			combined.Merge(snap)
+		}
+	}
+	return combined
+}
+
+// mergeAllShards synchronously snapshots and merges every shard's current stats, without going
+// through the results channel or waiting for a ticker. Used during shutdown to capture whatever was
+// aggregated since the last tick. Each snapshot is produced by the shard's own aggregateShard
+// goroutine via its flush channel rather than read directly, so this never races aggregateShard's
+// own reads/writes of s.stats.
+func mergeAllShards() *BufferedStats {
+	combined := NewBufferedStats()
+	for _, s := range shards {
+		respCh := make(chan *BufferedStats)
+		s.flush <- respCh
+		combined.Merge(<-respCh)
+	}
+	return combined
+}
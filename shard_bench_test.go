@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// maxAggregationBenchShards is the largest shard count BenchmarkAggregation exercises. The names set
+// it drives traffic with is sized to this so every shard actually receives load even at the highest
+// count under test -- with fewer distinct names than shards, the extra shards would sit idle and the
+// benchmark would show throughput flattening (or regressing) past name-count shards for a reason
+// that has nothing to do with sharding itself.
+const maxAggregationBenchShards = 32
+
+// BenchmarkAggregation drives real concurrent load through aggregateShard's incoming channels across
+// a range of shard counts, demonstrating that sharded aggregation actually scales throughput with
+// shard count (and therefore available cores) instead of being capped by a single goroutine and
+// BufferedStats the way the pre-sharding aggregator was.
+func BenchmarkAggregation(b *testing.B) {
+	origTicker := aggregateFlushTicker
+	defer func() { aggregateFlushTicker = origTicker }()
+	// Never fire: the benchmark only cares about incoming throughput, not flush behavior, and a real
+	// ticker would pull in conf.ClearStatsBetweenFlushes, which isn't set up here.
+	aggregateFlushTicker = func() <-chan time.Time { return make(chan time.Time) }
+
+	names := make([]string, maxAggregationBenchShards*4)
+	for i := range names {
+		names[i] = fmt.Sprintf("app.metric%d", i)
+	}
+
+	for _, n := range []int{1, 2, 4, 8, 16, maxAggregationBenchShards} {
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+
+			shards = make([]*aggregatorShard, n)
+			results := make(chan *BufferedStats, n)
+			var wg sync.WaitGroup
+			wg.Add(n)
+			for i := range shards {
+				shards[i] = &aggregatorShard{
+					incoming: make(chan *Stat, incomingQueueSize),
+					stats:    NewBufferedStats(),
+					flush:    make(chan chan *BufferedStats),
+				}
+				go func(s *aggregatorShard) {
+					defer wg.Done()
+					aggregateShard(ctx, s, results)
+				}(shards[i])
+			}
+			// Stop every aggregateShard goroutine and wait for it to actually exit before this b.Run
+			// body (and, for the last subtest, the top-level aggregateFlushTicker restore) returns --
+			// otherwise a still-running goroutine races the next subtest's (or the defer's) write to
+			// the global.
+			defer func() {
+				cancel()
+				wg.Wait()
+			}()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					name := names[i%len(names)]
+					shardFor(name).incoming <- &Stat{Type: StatCounter, Name: name, Value: 1, SampleRate: 1}
+					i++
+				}
+			})
+		})
+	}
+}
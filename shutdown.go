@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultShutdownTimeout bounds how long graceful shutdown waits for in-flight stats to drain and a
+// final flush to go out before giving up and exiting anyway. conf.ShutdownTimeoutMS overrides it.
+const defaultShutdownTimeout = 5 * time.Second
+
+// drainPollInterval is how often drainIncoming polls channel lengths while waiting for in-flight
+// stats to be picked up by the still-running aggregate goroutines.
+const drainPollInterval = 10 * time.Millisecond
+
+// drainTimeoutFraction is the share of the overall shutdown timeout given to drainIncoming. The rest
+// is left for finalFlush/closeSinks/cancel, so a drain that eats its whole budget (the case this
+// timeout exists for) can't also starve the final flush it's supposed to protect.
+const drainTimeoutFraction = 0.5
+
+// shutdownComplete is closed once the shutdown sequence has run to completion (or timed out) and
+// main is clear to let its own goroutine exit.
+var shutdownComplete = make(chan struct{})
+
+// listeners collects everything opened by main that needs to stop accepting new work before gost
+// can drain and flush safely. Closing a listener unblocks its Accept/ReadFrom call with an error,
+// which the owning goroutine (clientServer, streamServer, forwardServer) treats as a clean shutdown
+// rather than a fatal error once ctx is done.
+var listeners struct {
+	sync.Mutex
+	closers []io.Closer
+}
+
+func registerListener(c io.Closer) {
+	listeners.Lock()
+	defer listeners.Unlock()
+	listeners.closers = append(listeners.closers, c)
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM is received, then runs the shutdown sequence within
+// conf.ShutdownTimeoutMS: closing listeners, draining in-flight stats, flushing one last time, closing
+// the sinks and the forwarding connection (via cancel, which lets flushForwarding's deferred
+// conn.Close() run) and closing debug clients. shutdown itself only spends drainTimeoutFraction of
+// that budget on the drain, so a stuck drain still leaves time for the flush/close steps that follow
+// it before this outer timeout fires.
+func waitForShutdown(cancel context.CancelFunc) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	Infof(FacetNet, "Received %s; shutting down gracefully", sig)
+
+	timeout := defaultShutdownTimeout
+	if conf.ShutdownTimeoutMS > 0 {
+		timeout = time.Duration(conf.ShutdownTimeoutMS) * time.Millisecond
+	}
+
+	done := make(chan struct{})
+	go func() {
+		shutdown(cancel, timeout)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		Infof(FacetNet, "Graceful shutdown complete")
+	case <-time.After(timeout):
+		Warnf(FacetNet, "Graceful shutdown timed out; exiting anyway")
+	}
+	close(shutdownComplete)
+	os.Exit(0)
+}
+
+// shutdown runs the actual drain-and-flush sequence. drainIncoming only gets drainTimeout(timeout),
+// not the full budget, so a drain that runs out the clock still leaves the rest of timeout for the
+// final flush and sink/connection teardown below it -- the steps waitForShutdown's own timeout exists
+// to protect. The final flush is written directly to the sinks and the forwarded-stats sink, since
+// both now own their connections independently rather than relying on a flush goroutine's deferred
+// Close(). cancel is called last, stopping every remaining ctx-aware goroutine (in particular
+// flushForwarding, whose deferred conn.Close() closes the forwarding connection opened by DialPConn).
+func shutdown(cancel context.CancelFunc, timeout time.Duration) {
+	closeListeners()
+	drainIncoming(drainTimeout(timeout))
+	finalFlush()
+	closeSinks(sinks)
+	if forwardedSink != nil {
+		if err := forwardedSink.Close(); err != nil {
+			Warnf(FacetSink, "forwarded sink %s failed to close: %s", forwardedSink.Name(), err)
+		}
+	}
+	cancel()
+	debugServer.closeAll()
+}
+
+// drainTimeout returns the portion of the overall shutdown timeout that drainIncoming is allowed to
+// spend, reserving the remainder of timeout for the final flush and sink/connection teardown that
+// follow it in shutdown.
+func drainTimeout(timeout time.Duration) time.Duration {
+	return time.Duration(float64(timeout) * drainTimeoutFraction)
+}
+
+func closeListeners() {
+	listeners.Lock()
+	defer listeners.Unlock()
+	for _, c := range listeners.closers {
+		c.Close()
+	}
+}
+
+// drainIncoming waits for the shard, forwardingIncoming and forwarderIncoming channels to empty out,
+// giving the still-running aggregate goroutines a chance to account for messages that were already
+// accepted before the listeners closed. It gives up after timeout so a stuck consumer can't hang
+// shutdown forever.
+func drainIncoming(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if incomingDrained() {
+			return
+		}
+		time.Sleep(drainPollInterval)
+	}
+	Warnf(FacetNet, "Shutdown: timed out waiting for in-flight stats to drain")
+}
+
+func incomingDrained() bool {
+	if len(forwardingIncoming) != 0 || len(forwarderIncoming) != 0 {
+		return false
+	}
+	for _, s := range shards {
+		if len(s.incoming) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// finalFlush flushes the shards and forwardedStats through the same sinks the regular ticker-driven
+// flushes use, and hands forwardingStats to forwardingOutgoing while flushForwarding is still running
+// to receive it. It uses context.Background() rather than the shutting-down ctx so the flush itself
+// isn't cancelled by the very shutdown it's part of.
+func finalFlush() {
+	fanOutSinks(context.Background(), sinks, mergeAllShards())
+	if forwardedSink != nil {
+		if err := forwardedSink.Write(context.Background(), forwardedStats); err != nil {
+			Errorf(FacetSink, "sink."+forwardedSink.Name()+".write", "forwarded sink %s failed to write: %s", forwardedSink.Name(), err)
+		}
+	}
+	if forwardingEnabled {
+		if n, snap := forwardingStats.CreateForwardSnapshot(); n > 0 {
+			forwardingOutgoing <- snap
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Sink is an output backend for flushed stats. BufferedStats itself doesn't know about Graphite,
+// InfluxDB, Prometheus or OTLP -- each Sink implementation is responsible for turning a snapshot into
+// whatever its backend expects and getting it there.
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, snapshot *BufferedStats) error
+	Close() error
+}
+
+// SinkConf is one entry of Conf.Sinks. Addr and Options are interpreted by the sink's own factory;
+// Options holds whatever per-sink settings (API keys, bucket names, resource attributes, ...) a
+// given backend needs that don't fit Name/Type/Addr.
+type SinkConf struct {
+	Name string
+	Type string
+	Addr string
+
+	// Namespace overrides conf.Namespace for sinks that prefix metric names with a namespace (just
+	// graphite today). It exists so the same sink type can be reused for both the regular stats flush
+	// and the distinct forwarded-stats flush, which have historically used different namespaces.
+	Namespace string
+
+	// MetaCounter overrides the default meta counter name emitted for a flush (just graphite today,
+	// as "distinct_metrics_flushed"). Like Namespace, it exists so the same sink type can be reused
+	// for the forwarded-stats flush, which has historically emitted a distinct
+	// "distinct_forwarded_metrics_flushed" counter instead.
+	MetaCounter string
+
+	Options map[string]string
+}
+
+// sinkFactories maps a SinkConf.Type (e.g. "graphite", "influxdb", "prometheus_remote_write",
+// "otlp") to a constructor. Each sink implementation registers itself with registerSink from an
+// init() in its own file.
+var sinkFactories = map[string]func(SinkConf) (Sink, error){}
+
+func registerSink(typ string, factory func(SinkConf) (Sink, error)) {
+	sinkFactories[typ] = factory
+}
+
+// newSinks builds every sink in confs, in order, failing fast on an unrecognized type or a
+// constructor error so a typo'd config doesn't silently drop a backend.
+func newSinks(confs []SinkConf) ([]Sink, error) {
+	sinks := make([]Sink, 0, len(confs))
+	for _, c := range confs {
+		factory, ok := sinkFactories[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("sink %q: unknown type %q", c.Name, c.Type)
+		}
+		s, err := factory(c)
+		if err != nil {
+			return nil, fmt.Errorf("sink %q: %w", c.Name, err)
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// fanOutSinks writes snapshot to every sink concurrently and waits for all of them to finish. A
+// sink's Write error is logged and counted under errors.sink.<name>.write rather than aborting the
+// other sinks' writes.
+func fanOutSinks(ctx context.Context, sinks []Sink, snapshot *BufferedStats) {
+	var wg sync.WaitGroup
+	wg.Add(len(sinks))
+	for _, s := range sinks {
+		go func(s Sink) {
+			defer wg.Done()
+			if err := s.Write(ctx, snapshot); err != nil {
+				Errorf(FacetSink, fmt.Sprintf("sink.%s.write", s.Name()), "sink %s failed to write: %s", s.Name(), err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// closeSinks closes every sink, logging (but not failing on) individual close errors. Called during
+// shutdown once the final flush has gone out.
+func closeSinks(sinks []Sink) {
+	for _, s := range sinks {
+		if err := s.Close(); err != nil {
+			Warnf(FacetSink, "sink %s failed to close: %s", s.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net"
+)
+
+func init() {
+	registerSink("graphite", newGraphiteSink)
+}
+
+// defaultGraphiteMetaCounter is the meta counter name used when a SinkConf doesn't set MetaCounter.
+const defaultGraphiteMetaCounter = "distinct_metrics_flushed"
+
+// graphiteSink reproduces gost's original, and still default, behavior: format a snapshot as
+// Graphite plaintext and write it to a single persistent connection opened with DialPConn.
+type graphiteSink struct {
+	name        string
+	namespace   string
+	metaCounter string
+	conn        net.Conn
+}
+
+func newGraphiteSink(c SinkConf) (Sink, error) {
+	namespace := c.Namespace
+	if namespace == "" {
+		namespace = conf.Namespace
+	}
+	metaCounter := c.MetaCounter
+	if metaCounter == "" {
+		metaCounter = defaultGraphiteMetaCounter
+	}
+	return &graphiteSink{
+		name:        c.Name,
+		namespace:   namespace,
+		metaCounter: metaCounter,
+		conn:        DialPConn(c.Addr),
+	}, nil
+}
+
+func (s *graphiteSink) Name() string { return s.name }
+
+func (s *graphiteSink) Write(ctx context.Context, snapshot *BufferedStats) error {
+	_, msg := snapshot.CreateGraphiteMessage(s.namespace, s.metaCounter)
+	Debugf(FacetSink, "out: %s", msg)
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+func (s *graphiteSink) Close() error {
+	return s.conn.Close()
+}
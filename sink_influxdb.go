@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func init() {
+	registerSink("influxdb", newInfluxDBSink)
+}
+
+// influxDBSink writes snapshots as InfluxDB line protocol, either fire-and-forget over UDP (like the
+// Graphite sink) or over HTTP to the /write API, selected by Options["mode"].
+type influxDBSink struct {
+	name string
+
+	udpConn net.Conn // set when writing over UDP
+
+	httpClient *http.Client // set when writing over HTTP
+	writeURL   string
+}
+
+func newInfluxDBSink(c SinkConf) (Sink, error) {
+	s := &influxDBSink{name: c.Name}
+	switch c.Options["mode"] {
+	case "", "udp":
+		conn, err := net.Dial("udp", c.Addr)
+		if err != nil {
+			return nil, err
+		}
+		s.udpConn = conn
+	case "http":
+		s.httpClient = &http.Client{Timeout: 5 * time.Second}
+		s.writeURL = fmt.Sprintf("http://%s/write?db=%s", c.Addr, c.Options["database"])
+	default:
+		return nil, fmt.Errorf("unknown influxdb sink mode %q", c.Options["mode"])
+	}
+	return s, nil
+}
+
+func (s *influxDBSink) Name() string { return s.name }
+
+func (s *influxDBSink) Write(ctx context.Context, snapshot *BufferedStats) error {
+	lines := influxLineProtocol(snapshot, now())
+	if len(lines) == 0 {
+		return nil
+	}
+	if s.udpConn != nil {
+		_, err := s.udpConn.Write(lines)
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.writeURL, bytes.NewReader(lines))
+	if err != nil {
+		return err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("influxdb write returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *influxDBSink) Close() error {
+	if s.udpConn != nil {
+		return s.udpConn.Close()
+	}
+	return nil
+}
+
+// influxLineProtocol renders a snapshot as InfluxDB line protocol, one line per stat. Unlike
+// Graphite's dotted namespace, InfluxDB has native tags, but gost doesn't have any to attach yet --
+// measurement names are just the stat name, with no namespace prefix and no tags.
+func influxLineProtocol(snapshot *BufferedStats, at time.Time) []byte {
+	var buf bytes.Buffer
+	ts := at.UnixNano()
+	for name, v := range snapshot.Counts {
+		fmt.Fprintf(&buf, "%s count=%s %d\n", name, strconv.FormatFloat(v, 'f', -1, 64), ts)
+	}
+	for name, v := range snapshot.Gauges {
+		fmt.Fprintf(&buf, "%s gauge=%s %d\n", name, strconv.FormatFloat(v, 'f', -1, 64), ts)
+	}
+	for name, values := range snapshot.Timers {
+		for _, v := range values {
+			fmt.Fprintf(&buf, "%s timer=%s %d\n", name, strconv.FormatFloat(v, 'f', -1, 64), ts)
+		}
+	}
+	for name, items := range snapshot.Sets {
+		fmt.Fprintf(&buf, "%s set_count=%di %d\n", name, len(items), ts)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+func init() {
+	registerSink("otlp", newOTLPSink)
+}
+
+// otlpSink POSTs snapshots as OTLP/HTTP metrics using the JSON encoding of
+// opentelemetry.proto.collector.metrics.v1.ExportMetricsServiceRequest. JSON rather than protobuf so
+// this sink only needs the standard library, unlike the Prometheus remote-write sink.
+type otlpSink struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+func newOTLPSink(c SinkConf) (Sink, error) {
+	return &otlpSink{
+		name:   c.Name,
+		url:    c.Addr,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+func (s *otlpSink) Name() string { return s.name }
+
+func (s *otlpSink) Write(ctx context.Context, snapshot *BufferedStats) error {
+	body, err := json.Marshal(otlpExportRequest(snapshot, now()))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("otlp export returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *otlpSink) Close() error { return nil }
+
+// The types below are a minimal subset of the OTLP metrics JSON schema -- just enough fields to
+// carry gost's counters, gauges, timers and sets as OTLP sum/gauge data points.
+type otlpExportMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name  string     `json:"name"`
+	Gauge *otlpGauge `json:"gauge,omitempty"`
+	Sum   *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+// otlpAggregationTemporalityDelta is AGGREGATION_TEMPORALITY_DELTA from
+// opentelemetry.proto.metrics.v1.AggregationTemporality: each data point covers just the interval
+// since the previous flush, not a running total since start. That's what gost's counters are --
+// stats.Clear is called every flush -- so every Sum gost emits uses this temporality.
+const otlpAggregationTemporalityDelta = 1
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+}
+
+type otlpNumberDataPoint struct {
+	TimeUnixNano string  `json:"timeUnixNano"`
+	AsDouble     float64 `json:"asDouble"`
+}
+
+func otlpExportRequest(snapshot *BufferedStats, at time.Time) otlpExportMetricsRequest {
+	ts := fmt.Sprintf("%d", at.UnixNano())
+	point := func(v float64) []otlpNumberDataPoint {
+		return []otlpNumberDataPoint{{TimeUnixNano: ts, AsDouble: v}}
+	}
+
+	var metrics []otlpMetric
+	for name, v := range snapshot.Counts {
+		metrics = append(metrics, otlpMetric{Name: name, Sum: &otlpSum{
+			DataPoints:             point(v),
+			IsMonotonic:            true,
+			AggregationTemporality: otlpAggregationTemporalityDelta,
+		}})
+	}
+	for name, v := range snapshot.Gauges {
+		metrics = append(metrics, otlpMetric{Name: name, Gauge: &otlpGauge{DataPoints: point(v)}})
+	}
+	for name, values := range snapshot.Timers {
+		for _, v := range values {
+			metrics = append(metrics, otlpMetric{Name: name, Gauge: &otlpGauge{DataPoints: point(v)}})
+		}
+	}
+	for name, items := range snapshot.Sets {
+		metrics = append(metrics, otlpMetric{Name: name + "_count", Gauge: &otlpGauge{DataPoints: point(float64(len(items)))}})
+	}
+
+	return otlpExportMetricsRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			ScopeMetrics: []otlpScopeMetrics{{Metrics: metrics}},
+		}},
+	}
+}
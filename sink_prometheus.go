@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func init() {
+	registerSink("prometheus_remote_write", newPrometheusSink)
+}
+
+// prometheusSink POSTs snapshots to a Prometheus remote-write endpoint as snappy-compressed
+// protobuf, per https://prometheus.io/docs/concepts/remote_write_spec/.
+type prometheusSink struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+func newPrometheusSink(c SinkConf) (Sink, error) {
+	return &prometheusSink{
+		name:   c.Name,
+		url:    c.Addr,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+func (s *prometheusSink) Name() string { return s.name }
+
+func (s *prometheusSink) Write(ctx context.Context, snapshot *BufferedStats) error {
+	req := &prompb.WriteRequest{Timeseries: prometheusTimeSeries(snapshot, now())}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	compressed := snappy.Encode(nil, data)
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(compressed))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("prometheus remote-write returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *prometheusSink) Close() error { return nil }
+
+// prometheusTimeSeries flattens a snapshot into Prometheus time series. Each recorded timer value
+// becomes its own sample on a series named <stat>_raw, since gost doesn't compute percentiles itself
+// -- that's left to Prometheus's own histogram/summary tooling downstream. Sets are exported as
+// their cardinality.
+func prometheusTimeSeries(snapshot *BufferedStats, at time.Time) []prompb.TimeSeries {
+	ts := at.UnixNano() / int64(time.Millisecond)
+	var series []prompb.TimeSeries
+	addSeries := func(name string, value float64) {
+		series = append(series, prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "__name__", Value: name}},
+			Samples: []prompb.Sample{{Value: value, Timestamp: ts}},
+		})
+	}
+	for name, v := range snapshot.Counts {
+		addSeries(name, v)
+	}
+	for name, v := range snapshot.Gauges {
+		addSeries(name, v)
+	}
+	for name, values := range snapshot.Timers {
+		for _, v := range values {
+			addSeries(name+"_raw", v)
+		}
+	}
+	for name, items := range snapshot.Sets {
+		addSeries(name+"_count", float64(len(items)))
+	}
+	return series
+}